@@ -16,61 +16,193 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/bits"
 	"strconv"
 
 	"github.com/dchest/siphash"
 )
 
+// mode selects how a Filter behaves when its current layer approaches
+// saturation.
+type mode int
+
+const (
+	// modeFixed is the original behavior: once the projected load would
+	// exceed MaxEntries, the oldest layer is dropped, permanently losing
+	// the membership information it held.
+	modeFixed mode = iota
+
+	// modeScalable never drops layers. Instead, each time the current
+	// layer's estimated false-positive rate would exceed the target,
+	// Delta starts a new, larger layer with a tighter target FPR. See
+	// NewScalable.
+	modeScalable
+)
+
+// layer is one generation of a Filter: its own bitmap plus the hash
+// geometry (mask, k) and entry count it was sized for. In modeFixed all
+// layers of a Filter share the same mask and k; in modeScalable later
+// layers are progressively larger with a tighter k.
+type layer struct {
+	bits []byte
+
+	mask uint64
+	k    int
+
+	nrEntriesMax int
+	nrEntries    int
+}
+
 // Filter is a delta-compressable bloom filter.
 // following the logic from http://www.eecs.harvard.edu/~michaelm/NEWWORK/postscripts/cbf2.pdf
 type Filter struct {
-	b        [][]byte
+	layers []layer
 
 	k1, k2 uint64
+	load   float64
 
-	mask uint64
+	mode mode
+
+	// growthFactor and tighteningRatio are only meaningful in
+	// modeScalable: see NewScalable.
+	growthFactor    float64
+	tighteningRatio float64
+	targetFPR       float64
+
+	// mask, k and nrEntriesMax mirror layers[0] (the current, most
+	// recently created layer), kept in sync so MaxEntries/K read as if
+	// the Filter had a single fixed geometry.
+	mask         uint64
+	k            int
 	nrEntriesMax int
-	nrEntries    []int
 }
 
 // New constructs a new Filter with a filter set size of 2^mLn2
 // which allows an entry factor up to load before dropping layers
-// at new deltas.
+// at new deltas. The number of hash functions (k) is chosen
+// automatically to minimize the false-positive rate at that load.
 func New(rand io.Reader, mLn2 int, load float64) (*Filter, error) {
-	const maxMln2 = strconv.IntSize - 1
+	return NewWithK(rand, mLn2, load, 0)
+}
 
-	var key [16]byte
-	if _, err := io.ReadFull(rand, key[:]); err != nil {
+// NewWithK is New, but with an explicit number of hash functions k.
+// Passing k=0 auto-selects the optimal k = round((m/n) * ln 2) for
+// the requested mLn2 and load. Entries are then hashed into k bit
+// positions derived via Kirsch-Mitzenmacher double-hashing from a
+// single siphash-128 evaluation, rather than a single position.
+func NewWithK(rand io.Reader, mLn2 int, load float64, k int) (*Filter, error) {
+	if load <= 0.0 || load > 1.0 {
+		return nil, fmt.Errorf("invalid load rate: %v", load)
+	}
+	if k < 0 {
+		return nil, fmt.Errorf("invalid k: %v", k)
+	}
+
+	k1, k2, err := newHashKeys(rand)
+	if err != nil {
 		return nil, err
 	}
 
-	if load <= 0.0 || load > 1.0 {
-		return nil, fmt.Errorf("invalid load rate: %v", load)
+	l, err := newLayer(mLn2, load, k)
+	if err != nil {
+		return nil, err
+	}
+
+	f := new(Filter)
+	f.k1, f.k2 = k1, k2
+	f.load = load
+	f.layers = []layer{l}
+	f.mask, f.k, f.nrEntriesMax = l.mask, l.k, l.nrEntriesMax
+	return f, nil
+}
+
+// NewScalable constructs a Filter that never drops layers. load is the
+// initial target false-positive rate P0: k is derived directly from it as
+// k = ceil(-log2(P0)), the standard Almeida et al. construction, so the
+// filter actually grows once a layer's estimated FPR reaches load (not
+// some other value k happens to imply). Once that happens, Delta allocates
+// a new, larger layer, targeting an FPR tightened by tighteningRatio
+// (0 < tighteningRatio < 1) each generation. Layer sizes are powers of two,
+// so the new layer is growthFactor rounded to the nearest power of two (at
+// least 2) times larger in bits, not exactly growthFactor times larger.
+// mLn2 sizes the initial layer exactly as in New.
+func NewScalable(rand io.Reader, mLn2 int, load float64, growthFactor, tighteningRatio float64) (*Filter, error) {
+	if growthFactor <= 1.0 {
+		return nil, fmt.Errorf("invalid growth factor: %v", growthFactor)
+	}
+	if tighteningRatio <= 0.0 || tighteningRatio >= 1.0 {
+		return nil, fmt.Errorf("invalid tightening ratio: %v", tighteningRatio)
+	}
+
+	f, err := NewWithK(rand, mLn2, load, scalableK(load))
+	if err != nil {
+		return nil, err
 	}
+	f.mode = modeScalable
+	f.growthFactor = growthFactor
+	f.tighteningRatio = tighteningRatio
+	f.targetFPR = load
+	return f, nil
+}
+
+// scalableK derives the number of hash functions that minimizes FPR for a
+// scalable Filter targeting false-positive rate p: k = ceil(-log2(p)).
+func scalableK(p float64) int {
+	k := int(math.Ceil(-math.Log2(p)))
+	if k < 1 {
+		k = 1
+	}
+	return k
+}
+
+// newHashKeys draws the siphash key pair shared by every layer of a Filter.
+func newHashKeys(rand io.Reader) (uint64, uint64, error) {
+	var key [16]byte
+	if _, err := io.ReadFull(rand, key[:]); err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(key[0:8]), binary.BigEndian.Uint64(key[8:16]), nil
+}
+
+// newLayer sizes a single layer with filter set size 2^mLn2, auto-selecting
+// k (pass k=0) and the achievable entry count from the classic Bloom filter
+// FPR formula as in NewWithK.
+func newLayer(mLn2 int, load float64, k int) (layer, error) {
+	const maxMln2 = strconv.IntSize - 1
 
 	if mLn2 > maxMln2 {
-		return nil, fmt.Errorf("requested filter too large: %d", mLn2)
+		return layer{}, fmt.Errorf("requested filter too large: %d", mLn2)
 	}
 
 	m := uint64(1 << uint64(mLn2))
-	n := float64(m) * load
+	nTarget := float64(m) * load
+
+	if k == 0 {
+		k = int(math.Round((float64(m) / nTarget) * math.Ln2))
+		if k < 1 {
+			k = 1
+		}
+	}
+
+	// Recompute the achievable entry count from the classic Bloom
+	// filter FPR formula using the (possibly rounded) k, rather than
+	// just using m*load directly.
+	n := (float64(m) / float64(k)) * math.Ln2
 
 	if uint64(n) > (1 << uint(maxMln2)) {
-		return nil, fmt.Errorf("requested filter too large (nrEntriesMax overflow): %d", mLn2)
+		return layer{}, fmt.Errorf("requested filter too large (nrEntriesMax overflow): %d", mLn2)
 	}
 
-	f := new(Filter)
-	f.k1 = binary.BigEndian.Uint64(key[0:8])
-	f.k2 = binary.BigEndian.Uint64(key[8:16])
-	f.mask = m - 1
-	f.nrEntriesMax = int(n)
-	f.b = [][]byte{make([]byte, m/8)}
-	f.nrEntries = make([]int, 1)
-	return f, nil
+	return layer{
+		bits:         make([]byte, m/8),
+		mask:         m - 1,
+		k:            k,
+		nrEntriesMax: int(n),
+	}, nil
 }
 
-// MaxEntries returns the maximum capacity of the Filter.
+// MaxEntries returns the maximum capacity of the Filter's current layer.
 func (f *Filter) MaxEntries() int {
 	return f.nrEntriesMax
 }
@@ -79,8 +211,8 @@ func (f *Filter) MaxEntries() int {
 // Filter.
 func (f *Filter) Entries() int {
 	entries := 0
-	for i := 0; i < len(f.nrEntries); i++ {
-		entries += f.nrEntries[i]
+	for i := range f.layers {
+		entries += f.layers[i].nrEntries
 	}
 	return entries
 }
@@ -88,43 +220,209 @@ func (f *Filter) Entries() int {
 // TestAndSet tests the Filter for a given value's membership, adds the value
 // to the filter, and returns true iff it was present at the time of the call.
 func (f *Filter) TestAndSet(b []byte) bool {
-	h := f.hash(b)
+	h1, h2 := f.hash(b)
 	// Just return true iff the entry is present.
-	if f.test(h) {
+	if f.test(h1, h2) {
 		return true
 	}
 
 	// Add and return false.
-	f.add(h)
-	f.nrEntries[0]++
+	f.add(h1, h2)
+	f.layers[0].nrEntries++
 	return false
 }
 
-func (f *Filter) Import(layer []byte) error {
-	if len(layer) != len(f.b[0]) {
+// Import adds a peer's exported Delta to f as its current layer, layers[0],
+// recording it with f's current geometry (the geometry it must have been
+// produced with, since Delta layers are always sized from the then-current
+// layer). Subsequent inserts go into the imported layer, and the layer f
+// was filling before becomes layers[1].
+// k must match the number of hash functions the exporting layer was built
+// with; byte length alone can't distinguish two scalable filters that
+// reached the same layer size via different (growthFactor, tighteningRatio)
+// configs, so a k mismatch is rejected the same way Union/Intersect reject
+// incompatible filters.
+func (f *Filter) Import(bits []byte, k int) error {
+	if len(bits) != len(f.layers[0].bits) {
 		return errors.New("Invalid layer size")
 	}
-	f.b = append([][]byte{layer}, f.b...)
-	c := f.count(layer)
-	f.nrEntries = append([]int{c}, f.nrEntries...)
+	if k != f.k {
+		return errors.New("bloom: incompatible filter parameters")
+	}
+	l := layer{bits: bits, mask: f.mask, k: f.k, nrEntriesMax: f.nrEntriesMax}
+	l.nrEntries = f.count(bits) / l.k
+	f.layers = append([]layer{l}, f.layers...)
 	f.checkExpiry()
 	return nil
 }
 
+// Delta freezes the current layer, returning its accumulated bits for
+// export to peers, and starts a fresh layer for subsequent inserts. In
+// modeScalable, if the frozen layer's estimated false-positive rate has
+// reached the target, the new layer is grown; otherwise it matches the
+// frozen layer's geometry.
 func (f *Filter) Delta() []byte {
-	newLayer := make([]byte, len(f.b[0]))
-	f.b = append([][]byte{newLayer}, f.b...)
-	f.nrEntries = append([]int{0}, f.nrEntries...)
+	frozen := f.layers[0]
+
+	var next layer
+	if f.mode == modeScalable && f.layerFPR(frozen) >= f.targetFPR {
+		next = f.growLayer()
+	} else {
+		next = layer{bits: make([]byte, len(frozen.bits)), mask: frozen.mask, k: frozen.k, nrEntriesMax: frozen.nrEntriesMax}
+	}
+
+	f.layers = append([]layer{next}, f.layers...)
+	f.mask, f.k, f.nrEntriesMax = next.mask, next.k, next.nrEntriesMax
 	f.checkExpiry()
-	return f.b[1]
+	return frozen.bits
+}
+
+// growLayer allocates the next layer for a modeScalable Filter: growthFactor
+// rounded to the nearest power of two (at least 2) times larger in bits,
+// targeting load*tighteningRatio.
+func (f *Filter) growLayer() layer {
+	curMLn2 := bits.Len64(f.mask)
+	growthBits := int(math.Round(math.Log2(f.growthFactor)))
+	if growthBits < 1 {
+		growthBits = 1
+	}
+
+	f.load *= f.tighteningRatio
+	f.targetFPR = f.load
+
+	l, err := newLayer(curMLn2+growthBits, f.load, scalableK(f.load))
+	if err != nil {
+		// The caller has no room to report an error from Delta; fall
+		// back to a same-size layer rather than panicking.
+		return layer{bits: make([]byte, len(f.layers[0].bits)), mask: f.mask, k: f.k, nrEntriesMax: f.nrEntriesMax}
+	}
+	return l
+}
+
+// RebuildFrom atomically constructs a fresh Filter from an authoritative
+// source, sharing f's hash keys and mode, and swaps it into f in place of
+// the current layers. iter is called with a yield function that should be
+// invoked once per member to insert; yield always returns true, so the
+// rebuild covers every member iter yields before it returns. The fresh filter starts at f's current (most recently
+// tuned) layer geometry, and in modeScalable grows mid-rebuild exactly as
+// Delta would, so that rebuilding from more members than the initial
+// layer's capacity still yields a filter that can tell members apart from
+// non-members, never forgetting. This mirrors the periodic-restart
+// workflow used to guarantee a scalable Filter never accumulates unbounded
+// state.
+func (f *Filter) RebuildFrom(iter func(yield func([]byte) bool)) {
+	base := f.layers[0]
+
+	fresh := &Filter{
+		k1: f.k1, k2: f.k2, load: f.load,
+		mode:            f.mode,
+		growthFactor:    f.growthFactor,
+		tighteningRatio: f.tighteningRatio,
+		targetFPR:       f.targetFPR,
+		layers:          []layer{{bits: make([]byte, len(base.bits)), mask: base.mask, k: base.k, nrEntriesMax: base.nrEntriesMax}},
+		mask:            base.mask,
+		k:               base.k,
+		nrEntriesMax:    base.nrEntriesMax,
+	}
+
+	iter(func(b []byte) bool {
+		fresh.TestAndSet(b)
+		// Drive growth inline, the same way Delta would on export: once
+		// the current layer's estimated FPR reaches the target, rotate
+		// in a larger one rather than letting it saturate.
+		if fresh.mode == modeScalable && fresh.layerFPR(fresh.layers[0]) >= fresh.targetFPR {
+			fresh.Delta()
+		}
+		return true
+	})
+
+	*f = *fresh
+}
+
+// Union merges other's topmost layer into f's topmost layer by OR-ing their
+// bits together, so that f subsequently tests true for anything other's
+// topmost layer held; other's older layers are not merged. f and other must
+// share identical mask, k1, k2 and k.
+func (f *Filter) Union(other *Filter) error {
+	if err := f.checkCompatible(other); err != nil {
+		return err
+	}
+	top := other.layers[0].bits
+	for i := range f.layers[0].bits {
+		f.layers[0].bits[i] |= top[i]
+	}
+	f.layers[0].nrEntries = f.count(f.layers[0].bits) / f.k
+	return nil
+}
+
+// Intersect merges other's topmost layer into f's topmost layer by AND-ing
+// their bits together, so that f's topmost layer keeps only bits set in both
+// topmost layers. f's older layers are left as they are, so f still tests
+// true for values they hold. f and other must share identical mask, k1, k2
+// and k.
+func (f *Filter) Intersect(other *Filter) error {
+	if err := f.checkCompatible(other); err != nil {
+		return err
+	}
+	top := other.layers[0].bits
+	for i := range f.layers[0].bits {
+		f.layers[0].bits[i] &= top[i]
+	}
+	f.layers[0].nrEntries = f.count(f.layers[0].bits) / f.k
+	return nil
+}
+
+func (f *Filter) checkCompatible(other *Filter) error {
+	if f.mask != other.mask || f.k1 != other.k1 || f.k2 != other.k2 || f.k != other.k {
+		return errors.New("bloom: incompatible filter parameters")
+	}
+	return nil
+}
+
+// EstimateCardinality estimates the number of distinct entries represented
+// across all of f's layers, using the Swamidass-Baldi estimator
+// n ~= -(m/k) * ln(1 - X/m), where X is the popcount of the bitwise union
+// of all layers. This is most useful after a Union to reason about how
+// saturated the merged filter has become.
+func (f *Filter) EstimateCardinality() float64 {
+	m := float64(f.mask + 1)
+	x := float64(f.popcountUnion())
+	if x >= m {
+		x = m - 1
+	}
+	return -(m / float64(f.k)) * math.Log(1-x/m)
+}
+
+func (f *Filter) popcountUnion() int {
+	merged := make([]byte, len(f.layers[0].bits))
+	for i := range f.layers {
+		// In modeScalable, older layers are progressively smaller than
+		// layers[0] (merged's size), so only OR in the bytes they
+		// actually have.
+		layerBits := f.layers[i].bits
+		n := len(layerBits)
+		if n > len(merged) {
+			n = len(merged)
+		}
+		for j := 0; j < n; j++ {
+			merged[j] |= layerBits[j]
+		}
+	}
+	return f.count(merged)
 }
 
 // Test tests the Filter for a given value's membership and returns true iff
 // it is present (or a false positive).
 func (f *Filter) Test(b []byte) bool {
-	return f.test(f.hash(b))
+	h1, h2 := f.hash(b)
+	return f.test(h1, h2)
 }
 
+// K returns the number of hash functions (bit positions per entry) the
+// Filter's current layer uses.
+func (f *Filter) K() int {
+	return f.k
+}
 
 func (f *Filter) count(b []byte) int {
 	var cnt int
@@ -134,30 +432,96 @@ func (f *Filter) count(b []byte) int {
 	return cnt
 }
 
+// layerFPR estimates a layer's current false-positive rate from its own
+// entry count, mask and k via the classic Bloom filter FPR formula.
+func (f *Filter) layerFPR(l layer) float64 {
+	m := float64(l.mask + 1)
+	k := float64(l.k)
+	n := float64(l.nrEntries)
+	return math.Pow(1-math.Exp(-k*n/m), k)
+}
+
 func (f *Filter) checkExpiry() {
-	ecnt := len(f.nrEntries)
+	if f.mode == modeScalable {
+		// Layers are never dropped; growLayer already sized the next
+		// layer to keep the overall FPR within target.
+		return
+	}
+
+	ecnt := len(f.layers)
 	ecntM := float64(ecnt + 1) / float64(ecnt)
-	if float64(f.Entries()) * ecntM >= float64(f.MaxEntries()) {
-		f.nrEntries = f.nrEntries[:ecnt-1]
-		f.b = f.b[:ecnt-1]
+	if float64(f.Entries())*ecntM >= float64(f.MaxEntries()) {
+		f.layers = f.layers[:ecnt-1]
 	}
 }
 
-func (f *Filter) hash(b []byte) uint64 {
-	h, _ := siphash.Hash128(f.k1, f.k2, b)
-	h &= f.mask
-	return h
+// hash computes the two siphash-128 halves used as the basis of
+// Kirsch-Mitzenmacher double-hashing: bit i of a layer is at
+// (h1 + i*h2) & layer.mask.
+func (f *Filter) hash(b []byte) (uint64, uint64) {
+	h1, h2 := siphash.Hash128(f.k1, f.k2, b)
+	return h1, h2
 }
 
-func (f *Filter) test(hash uint64) bool {
-	for i := 0; i < len(f.b); i++ {
-		if 0 != f.b[i][hash/8]&(1<<(hash&7)) {
+// test returns true iff the item is present. When every layer shares mask
+// and k (modeFixed, or a scalable Filter that hasn't grown past its first
+// layer), bits are OR'd together across layers before checking the k
+// positions - equivalent to one filter holding Entries() inserts over m
+// bits, matching what checkExpiry/MaxEntries assume. Layers with differing
+// geometry (grown scalable layers) can't be combined this way, so each is
+// instead queried independently against its own mask and k, and a match in
+// any one layer counts as present.
+func (f *Filter) test(h1, h2 uint64) bool {
+	if f.uniformLayers() {
+		mask, k := f.layers[0].mask, f.layers[0].k
+		for i := 0; i < k; i++ {
+			pos := (h1 + uint64(i)*h2) & mask
+			set := false
+			for l := range f.layers {
+				if 0 != f.layers[l].bits[pos/8]&(1<<(pos&7)) {
+					set = true
+					break
+				}
+			}
+			if !set {
+				return false
+			}
+		}
+		return true
+	}
+
+	for l := range f.layers {
+		mask, k := f.layers[l].mask, f.layers[l].k
+		present := true
+		for i := 0; i < k; i++ {
+			pos := (h1 + uint64(i)*h2) & mask
+			if 0 == f.layers[l].bits[pos/8]&(1<<(pos&7)) {
+				present = false
+				break
+			}
+		}
+		if present {
 			return true
 		}
 	}
 	return false
 }
 
-func (f *Filter) add(hash uint64) {
-	f.b[0][hash/8] |= (1 << (hash & 7))
+// uniformLayers reports whether every layer shares layers[0]'s mask and k,
+// making a bit-level OR-merge across layers valid.
+func (f *Filter) uniformLayers() bool {
+	for i := 1; i < len(f.layers); i++ {
+		if f.layers[i].mask != f.layers[0].mask || f.layers[i].k != f.layers[0].k {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) add(h1, h2 uint64) {
+	mask := f.layers[0].mask
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint64(i)*h2) & mask
+		f.layers[0].bits[pos/8] |= (1 << (pos & 7))
+	}
 }
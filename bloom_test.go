@@ -15,6 +15,7 @@ import (
 	"compress/zlib"
 	"crypto/rand"
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,19 +26,23 @@ func TestFilter(t *testing.T) {
 	const (
 		entryLength       = 32
 		filterSize        = 15 // 2^15 bits = 4 KiB
-
-		expectedEntries = 1024
+		load              = .03125
 	)
 
 	assert := assert.New(t)
 	require := require.New(t)
 
 	// 4 KiB filter, 1/2^5 (32 bit) load
-	f, err := New(rand.Reader, filterSize, .03125)
+	f, err := New(rand.Reader, filterSize, load)
 	require.NoError(err, "New()")
 	assert.Equal(0, f.Entries(), "Entries(), empty filter")
 
-	// Assert that the bloom filter math is correct.
+	// Assert that the bloom filter math (k auto-selection, and the
+	// entry count derived from it) is correct.
+	m := float64(uint64(1) << filterSize)
+	expectedK := int(math.Round((m / (m * load)) * math.Ln2))
+	expectedEntries := int((m / float64(expectedK)) * math.Ln2)
+	assert.Equal(expectedK, f.K(), "k")
 	assert.Equal(expectedEntries, f.MaxEntries(), "Max entries")
 
 	// Generate enough entries to fully saturate the filter.
@@ -91,6 +96,231 @@ func TestFilter(t *testing.T) {
 	assert.Equal(max, f.Entries(), "After tests") // Should still be = max.
 }
 
+func TestFilterUnionIntersect(t *testing.T) {
+	const (
+		entryLength = 32
+		filterSize  = 12
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	a, err := New(rand.Reader, filterSize, 0.25)
+	require.NoError(err, "New() a")
+	b, err := New(rand.Reader, filterSize, 0.25)
+	require.NoError(err, "New() b")
+	// Share hash keys and k so the filters are mergeable.
+	b.k1, b.k2, b.k = a.k1, a.k2, a.k
+
+	var onlyA, onlyB [entryLength]byte
+	rand.Read(onlyA[:])
+	rand.Read(onlyB[:])
+	a.TestAndSet(onlyA[:])
+	b.TestAndSet(onlyB[:])
+
+	union, err := New(rand.Reader, filterSize, 0.25)
+	require.NoError(err, "New() union")
+	union.k1, union.k2, union.k = a.k1, a.k2, a.k
+	require.NoError(union.Union(a), "Union(a)")
+	require.NoError(union.Union(b), "Union(b)")
+	assert.True(union.Test(onlyA[:]), "union contains onlyA")
+	assert.True(union.Test(onlyB[:]), "union contains onlyB")
+
+	intersect, err := New(rand.Reader, filterSize, 0.25)
+	require.NoError(err, "New() intersect")
+	intersect.k1, intersect.k2, intersect.k = a.k1, a.k2, a.k
+	require.NoError(intersect.Union(a), "seed intersect with a")
+	require.NoError(intersect.Intersect(b), "Intersect(b)")
+	assert.False(intersect.Test(onlyA[:]), "intersect should drop onlyA")
+
+	incompatible, err := New(rand.Reader, filterSize+1, 0.25)
+	require.NoError(err, "New() incompatible")
+	assert.Error(union.Union(incompatible), "Union() of incompatible filters")
+
+	cardinality := union.EstimateCardinality()
+	assert.InDelta(2, cardinality, 1, "EstimateCardinality")
+}
+
+func TestFilterMultiLayerUnion(t *testing.T) {
+	const (
+		entryLength = 32
+		filterSize  = 12
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := NewWithK(rand.Reader, filterSize, 0.25, 4)
+	require.NoError(err, "NewWithK()")
+
+	// Delta() freezes layer 0 and opens a fresh layer with the same
+	// mask and k, so the two layers are uniform and should be OR'd
+	// together when testing, not tested independently.
+	f.Delta()
+	require.Len(f.layers, 2, "expected two same-geometry layers")
+
+	var member [entryLength]byte
+	rand.Read(member[:])
+	h1, h2 := f.hash(member[:])
+
+	// Split member's k bit positions across the two layers so that
+	// neither layer alone has all k bits set.
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint64(i)*h2) & f.mask
+		l := i % 2
+		f.layers[l].bits[pos/8] |= 1 << (pos & 7)
+	}
+
+	for l := range f.layers {
+		assert.False(f.layers[l].k == f.k && allBitsSet(f.layers[l].bits, f.mask, f.k, h1, h2), "layer %d alone should not have every bit set", l)
+	}
+	assert.True(f.Test(member[:]), "member split across uniform layers should still test present")
+}
+
+func allBitsSet(data []byte, mask uint64, k int, h1, h2 uint64) bool {
+	for i := 0; i < k; i++ {
+		pos := (h1 + uint64(i)*h2) & mask
+		if 0 == data[pos/8]&(1<<(pos&7)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFilterImportRoundTrip(t *testing.T) {
+	const (
+		entryLength = 32
+		filterSize  = 12
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	src, err := NewWithK(rand.Reader, filterSize, 0.25, 4)
+	require.NoError(err, "NewWithK() src")
+
+	var member, absent [entryLength]byte
+	rand.Read(member[:])
+	rand.Read(absent[:])
+	src.TestAndSet(member[:])
+
+	delta := src.Delta()
+
+	dst, err := NewWithK(rand.Reader, filterSize, 0.25, 4)
+	require.NoError(err, "NewWithK() dst")
+	dst.k1, dst.k2 = src.k1, src.k2
+
+	require.NoError(dst.Import(delta, src.k), "Import()")
+	assert.True(dst.Test(member[:]), "imported layer should contain member")
+	assert.False(dst.Test(absent[:]), "imported layer should not contain absent")
+	assert.Equal(1, dst.Entries(), "Entries() after Import")
+
+	assert.Error(dst.Import(delta, src.k+1), "Import() should reject a k mismatch")
+}
+
+func TestScalableFilterGrows(t *testing.T) {
+	const entryLength = 32
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := NewScalable(rand.Reader, 8, 0.1, 2, 0.9)
+	require.NoError(err, "NewScalable()")
+
+	entries := make([][entryLength]byte, 0, 4096)
+	for i := 0; i < 4096; i++ {
+		var ent [entryLength]byte
+		rand.Read(ent[:])
+		if !f.TestAndSet(ent[:]) {
+			entries = append(entries, ent)
+		}
+		if i%256 == 255 {
+			f.Delta()
+		}
+	}
+
+	// All entries inserted across many deltas should still be found:
+	// a scalable filter must never forget.
+	for _, ent := range entries {
+		assert.True(f.Test(ent[:]), "Test() of entry inserted before growth")
+	}
+	assert.Greater(len(f.layers), 1, "expected multiple layers")
+}
+
+func TestScalableRebuildFrom(t *testing.T) {
+	const (
+		entryLength = 32
+		memberCount = 4096
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := NewScalable(rand.Reader, 8, 0.1, 2, 0.9)
+	require.NoError(err, "NewScalable()")
+
+	// Several stale members, not just one: at the requested load (0.1),
+	// a single stale probe has a non-negligible chance of being a false
+	// positive, so only the near-certainty that they can't *all* survive
+	// the rebuild as false positives demonstrates they were dropped.
+	const staleCount = 20
+	stale := make([][entryLength]byte, staleCount)
+	for i := range stale {
+		rand.Read(stale[i][:])
+		f.TestAndSet(stale[i][:])
+	}
+	f.Delta()
+
+	initialMaxEntries := f.MaxEntries()
+
+	// Far more members than the initial layer's capacity, so the rebuild
+	// must grow rather than saturate the filter to uselessness.
+	members := make([][entryLength]byte, 0, memberCount)
+	for len(members) < memberCount {
+		var ent [entryLength]byte
+		rand.Read(ent[:])
+		members = append(members, ent)
+	}
+
+	f.RebuildFrom(func(yield func([]byte) bool) {
+		for _, ent := range members {
+			if !yield(ent[:]) {
+				return
+			}
+		}
+	})
+
+	assert.Greater(f.MaxEntries(), initialMaxEntries, "MaxEntries should grow during rebuild")
+	assert.Greater(len(f.layers), 1, "rebuild from many members should produce multiple layers")
+
+	for _, ent := range members {
+		assert.True(f.Test(ent[:]), "Test() of rebuilt member")
+	}
+	staleSurvivors := 0
+	for _, ent := range stale {
+		if f.Test(ent[:]) {
+			staleSurvivors++
+		}
+	}
+	assert.Less(staleSurvivors, staleCount, "at least some members dropped by rebuild should test absent")
+
+	falsePositives := 0
+	const probes = 2000
+	for i := 0; i < probes; i++ {
+		var ent [entryLength]byte
+		rand.Read(ent[:])
+		if f.Test(ent[:]) {
+			falsePositives++
+		}
+	}
+	observedP := float64(falsePositives) / float64(probes)
+	assert.Less(observedP, 0.5, "rebuilt filter should not be saturated to near-100% false positives")
+
+	// layers now vary in size (scalable mode); EstimateCardinality must
+	// not panic when OR-ing them together.
+	assert.NotPanics(func() { f.EstimateCardinality() }, "EstimateCardinality() across grown layers")
+}
+
 func TestFilterCompression(t *testing.T) {
 	const (
 		entryLength       = 32
@@ -0,0 +1,177 @@
+// counting.go - Counting Bloom filter.
+// following Fan et al., "Summary Cache: A Scalable Wide-Area Web Cache
+// Sharing Protocol"
+//
+// To the extent possible under law, the author(s) have dedicated all copyright
+// and related and neighboring rights to this software to the public domain
+// worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along
+// with this software. If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package bloom
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/dchest/siphash"
+)
+
+// counterMax is the saturation point of a CountingFilter's 4-bit counters.
+const counterMax = 15
+
+// CountingFilter is a counting Bloom filter: like Filter, but each slot is
+// a 4-bit saturating counter (two packed per byte) rather than a single
+// bit, which allows Remove as well as Add. A locally-mutable CountingFilter
+// can be projected down to a compact, delta-compressible Filter with
+// Downgrade for transmission to peers.
+type CountingFilter struct {
+	counters []byte
+
+	k1, k2 uint64
+	k      int
+	load   float64
+
+	mask uint64
+}
+
+// NewCounting constructs a new CountingFilter with a filter set size of
+// 2^mLn2, auto-selecting k as in New.
+func NewCounting(rand io.Reader, mLn2 int, load float64) (*CountingFilter, error) {
+	return NewCountingWithK(rand, mLn2, load, 0)
+}
+
+// NewCountingWithK is NewCounting, but with an explicit number of hash
+// functions k. Passing k=0 auto-selects k as in NewWithK.
+func NewCountingWithK(rand io.Reader, mLn2 int, load float64, k int) (*CountingFilter, error) {
+	const maxMln2 = strconv.IntSize - 1
+
+	if load <= 0.0 || load > 1.0 {
+		return nil, fmt.Errorf("invalid load rate: %v", load)
+	}
+	if k < 0 {
+		return nil, fmt.Errorf("invalid k: %v", k)
+	}
+	if mLn2 > maxMln2 {
+		return nil, fmt.Errorf("requested filter too large: %d", mLn2)
+	}
+
+	k1, k2, err := newHashKeys(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	m := uint64(1) << uint64(mLn2)
+	if k == 0 {
+		nTarget := float64(m) * load
+		k = int(math.Round((float64(m) / nTarget) * math.Ln2))
+		if k < 1 {
+			k = 1
+		}
+	}
+
+	return &CountingFilter{
+		counters: make([]byte, m/2),
+		k1:       k1,
+		k2:       k2,
+		k:        k,
+		load:     load,
+		mask:     m - 1,
+	}, nil
+}
+
+// Add increments the k counters for b, saturating (and no-op-ing on further
+// Adds) at counterMax.
+func (cf *CountingFilter) Add(b []byte) {
+	h1, h2 := siphash.Hash128(cf.k1, cf.k2, b)
+	for i := 0; i < cf.k; i++ {
+		pos := (h1 + uint64(i)*h2) & cf.mask
+		if c := counterGet(cf.counters, pos); c < counterMax {
+			counterSet(cf.counters, pos, c+1)
+		}
+	}
+}
+
+// Remove decrements the k counters for b. It is the caller's responsibility
+// to only Remove values previously Added; removing an absent value will
+// incorrectly decrement counters shared with other members.
+func (cf *CountingFilter) Remove(b []byte) {
+	h1, h2 := siphash.Hash128(cf.k1, cf.k2, b)
+	for i := 0; i < cf.k; i++ {
+		pos := (h1 + uint64(i)*h2) & cf.mask
+		if c := counterGet(cf.counters, pos); c > 0 {
+			counterSet(cf.counters, pos, c-1)
+		}
+	}
+}
+
+// Count returns the minimum of b's k counters. While none of those counters
+// has saturated, this is an upper bound on the number of times b has been
+// Added without a matching Remove; Count never exceeds counterMax.
+func (cf *CountingFilter) Count(b []byte) uint8 {
+	h1, h2 := siphash.Hash128(cf.k1, cf.k2, b)
+	min := uint8(counterMax)
+	for i := 0; i < cf.k; i++ {
+		pos := (h1 + uint64(i)*h2) & cf.mask
+		if c := counterGet(cf.counters, pos); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// Test tests the CountingFilter for a given value's membership and returns
+// true iff it is present (or a false positive).
+func (cf *CountingFilter) Test(b []byte) bool {
+	return cf.Count(b) > 0
+}
+
+// Downgrade projects the counter array into a plain one-bit Filter layer
+// (a bit is set iff the corresponding counter is non-zero), suitable for
+// compact Delta() transmission to peers while cf keeps counting locally.
+func (cf *CountingFilter) Downgrade() *Filter {
+	bits := make([]byte, (cf.mask+1)/8)
+	for i := uint64(0); i <= cf.mask; i++ {
+		if counterGet(cf.counters, i) > 0 {
+			bits[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	nrEntriesMax := int((float64(cf.mask+1) / float64(cf.k)) * math.Ln2)
+	f := &Filter{
+		k1:   cf.k1,
+		k2:   cf.k2,
+		load: cf.load,
+		layers: []layer{{
+			bits:         bits,
+			mask:         cf.mask,
+			k:            cf.k,
+			nrEntriesMax: nrEntriesMax,
+		}},
+		mask:         cf.mask,
+		k:            cf.k,
+		nrEntriesMax: nrEntriesMax,
+	}
+	f.layers[0].nrEntries = f.count(bits) / f.k
+	return f
+}
+
+func counterGet(data []byte, i uint64) uint8 {
+	b := data[i/2]
+	if i%2 == 0 {
+		return b & 0x0F
+	}
+	return b >> 4
+}
+
+func counterSet(data []byte, i uint64, v uint8) {
+	idx := i / 2
+	if i%2 == 0 {
+		data[idx] = (data[idx] & 0xF0) | (v & 0x0F)
+	} else {
+		data[idx] = (data[idx] & 0x0F) | (v << 4)
+	}
+}
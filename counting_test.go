@@ -0,0 +1,86 @@
+// counting_test.go - Counting Bloom filter tests.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright
+// and related and neighboring rights to this software to the public domain
+// worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along
+// with this software. If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package bloom
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountingFilterAddRemove(t *testing.T) {
+	const entryLength = 32
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cf, err := NewCounting(rand.Reader, 12, 0.25)
+	require.NoError(err, "NewCounting()")
+
+	var ent [entryLength]byte
+	rand.Read(ent[:])
+
+	assert.False(cf.Test(ent[:]), "Test() before Add")
+	cf.Add(ent[:])
+	assert.True(cf.Test(ent[:]), "Test() after Add")
+	assert.Equal(uint8(1), cf.Count(ent[:]), "Count() after one Add")
+
+	cf.Add(ent[:])
+	assert.Equal(uint8(2), cf.Count(ent[:]), "Count() after two Adds")
+
+	cf.Remove(ent[:])
+	assert.Equal(uint8(1), cf.Count(ent[:]), "Count() after Remove")
+	assert.True(cf.Test(ent[:]), "Test() still true with one remaining count")
+
+	cf.Remove(ent[:])
+	assert.False(cf.Test(ent[:]), "Test() after removing the last count")
+}
+
+func TestCountingFilterSaturates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cf, err := NewCounting(rand.Reader, 12, 0.25)
+	require.NoError(err, "NewCounting()")
+
+	var ent [32]byte
+	rand.Read(ent[:])
+
+	for i := 0; i < counterMax+10; i++ {
+		cf.Add(ent[:])
+	}
+	assert.Equal(uint8(counterMax), cf.Count(ent[:]), "Count() should saturate at counterMax")
+}
+
+func TestCountingFilterDowngrade(t *testing.T) {
+	const entryLength = 32
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cf, err := NewCounting(rand.Reader, 12, 0.25)
+	require.NoError(err, "NewCounting()")
+
+	var present, absent [entryLength]byte
+	rand.Read(present[:])
+	rand.Read(absent[:])
+	cf.Add(present[:])
+
+	f := cf.Downgrade()
+	assert.True(f.Test(present[:]), "downgraded Filter should contain present")
+	assert.False(f.Test(absent[:]), "downgraded Filter should not contain absent")
+
+	// Removing from the CountingFilter shouldn't retroactively affect an
+	// already-downgraded Filter snapshot.
+	cf.Remove(present[:])
+	assert.True(f.Test(present[:]), "downgraded snapshot unaffected by later Remove")
+}
@@ -0,0 +1,276 @@
+// marshal.go - Filter snapshot (de)serialization.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright
+// and related and neighboring rights to this software to the public domain
+// worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along
+// with this software. If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package bloom
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/bits"
+)
+
+// filterVersion is the snapshot format version written by MarshalBinary,
+// MarshalBinaryCompressed, WriteTo and WriteToCompressed. Version 2 added
+// per-layer geometry (mask/k/nrEntriesMax) and the scalable-mode fields,
+// to support filters whose layers are not all the same size.
+const filterVersion = 2
+
+var (
+	// ErrInvalidVersion is returned when a snapshot was written by an
+	// incompatible (future or otherwise unrecognized) version of this
+	// package.
+	ErrInvalidVersion = errors.New("bloom: invalid or unsupported snapshot version")
+
+	// ErrCorruptSnapshot is returned when a snapshot's header checksum
+	// does not match its contents, or a layer fails to decode to its
+	// recorded size.
+	ErrCorruptSnapshot = errors.New("bloom: corrupt filter snapshot")
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler, serializing the full
+// multi-layer Filter state so that it can be checkpointed and later
+// restored with UnmarshalBinary.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := f.writeTo(&buf, false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalBinaryCompressed is MarshalBinary, but zlib-compresses each layer
+// before writing it. UnmarshalBinary, ReadFrom and WriteToCompressed's
+// counterpart all detect and decompress compressed snapshots transparently.
+func (f *Filter) MarshalBinaryCompressed() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := f.writeTo(&buf, true); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, restoring a Filter
+// previously serialized by MarshalBinary or MarshalBinaryCompressed.
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	_, err := f.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+// WriteTo implements io.WriterTo, writing the full uncompressed Filter
+// state.
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	return f.writeTo(w, false)
+}
+
+// WriteToCompressed is WriteTo, but zlib-compresses each layer.
+func (f *Filter) WriteToCompressed(w io.Writer) (int64, error) {
+	return f.writeTo(w, true)
+}
+
+func (f *Filter) writeTo(w io.Writer, compress bool) (int64, error) {
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint8(filterVersion))
+	var compressedByte uint8
+	if compress {
+		compressedByte = 1
+	}
+	binary.Write(&header, binary.BigEndian, compressedByte)
+	binary.Write(&header, binary.BigEndian, uint8(f.mode))
+	binary.Write(&header, binary.BigEndian, f.k1)
+	binary.Write(&header, binary.BigEndian, f.k2)
+	binary.Write(&header, binary.BigEndian, f.load)
+	binary.Write(&header, binary.BigEndian, f.growthFactor)
+	binary.Write(&header, binary.BigEndian, f.tighteningRatio)
+	binary.Write(&header, binary.BigEndian, f.targetFPR)
+	binary.Write(&header, binary.BigEndian, uint32(len(f.layers)))
+
+	crc := crc32.ChecksumIEEE(header.Bytes())
+
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(header.Bytes()); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.BigEndian, crc); err != nil {
+		return cw.n, err
+	}
+
+	for _, l := range f.layers {
+		payload := l.bits
+		if compress {
+			var cbuf bytes.Buffer
+			zw := zlib.NewWriter(&cbuf)
+			if _, err := zw.Write(l.bits); err != nil {
+				return cw.n, err
+			}
+			if err := zw.Close(); err != nil {
+				return cw.n, err
+			}
+			payload = cbuf.Bytes()
+		}
+		if err := binary.Write(cw, binary.BigEndian, uint8(bits.Len64(l.mask))); err != nil {
+			return cw.n, err
+		}
+		if err := binary.Write(cw, binary.BigEndian, uint32(l.k)); err != nil {
+			return cw.n, err
+		}
+		if err := binary.Write(cw, binary.BigEndian, uint32(l.nrEntriesMax)); err != nil {
+			return cw.n, err
+		}
+		if err := binary.Write(cw, binary.BigEndian, uint32(l.nrEntries)); err != nil {
+			return cw.n, err
+		}
+		if err := binary.Write(cw, binary.BigEndian, uint32(len(payload))); err != nil {
+			return cw.n, err
+		}
+		if _, err := cw.Write(payload); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadFrom implements io.ReaderFrom, restoring a Filter previously written
+// by WriteTo or WriteToCompressed (the compressed form is detected and
+// decompressed transparently).
+func (f *Filter) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+
+	var header bytes.Buffer
+	tr := io.TeeReader(cr, &header)
+
+	var version, compressedByte, modeByte uint8
+	var k1, k2 uint64
+	var load, growthFactor, tighteningRatio, targetFPR float64
+	var numLayers uint32
+
+	if err := binary.Read(tr, binary.BigEndian, &version); err != nil {
+		return cr.n, err
+	}
+	if version != filterVersion {
+		return cr.n, ErrInvalidVersion
+	}
+	if err := binary.Read(tr, binary.BigEndian, &compressedByte); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &modeByte); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &k1); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &k2); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &load); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &growthFactor); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &tighteningRatio); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &targetFPR); err != nil {
+		return cr.n, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &numLayers); err != nil {
+		return cr.n, err
+	}
+
+	var wantCRC uint32
+	if err := binary.Read(cr, binary.BigEndian, &wantCRC); err != nil {
+		return cr.n, err
+	}
+	if crc32.ChecksumIEEE(header.Bytes()) != wantCRC {
+		return cr.n, ErrCorruptSnapshot
+	}
+
+	layers := make([]layer, numLayers)
+	for i := uint32(0); i < numLayers; i++ {
+		var mLn2 uint8
+		var k, nrEntriesMax, nrEntries, dataLen uint32
+		if err := binary.Read(cr, binary.BigEndian, &mLn2); err != nil {
+			return cr.n, err
+		}
+		if err := binary.Read(cr, binary.BigEndian, &k); err != nil {
+			return cr.n, err
+		}
+		if err := binary.Read(cr, binary.BigEndian, &nrEntriesMax); err != nil {
+			return cr.n, err
+		}
+		if err := binary.Read(cr, binary.BigEndian, &nrEntries); err != nil {
+			return cr.n, err
+		}
+		if err := binary.Read(cr, binary.BigEndian, &dataLen); err != nil {
+			return cr.n, err
+		}
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(cr, data); err != nil {
+			return cr.n, err
+		}
+
+		m := uint64(1) << uint64(mLn2)
+		if compressedByte == 1 {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return cr.n, ErrCorruptSnapshot
+			}
+			plain := make([]byte, m/8)
+			if _, err := io.ReadFull(zr, plain); err != nil {
+				return cr.n, ErrCorruptSnapshot
+			}
+			zr.Close()
+			data = plain
+		}
+		if uint64(len(data)) != m/8 {
+			return cr.n, ErrCorruptSnapshot
+		}
+		layers[i] = layer{bits: data, mask: m - 1, k: int(k), nrEntriesMax: int(nrEntriesMax), nrEntries: int(nrEntries)}
+	}
+	if len(layers) == 0 {
+		return cr.n, ErrCorruptSnapshot
+	}
+
+	f.k1 = k1
+	f.k2 = k2
+	f.load = load
+	f.mode = mode(modeByte)
+	f.growthFactor = growthFactor
+	f.tighteningRatio = tighteningRatio
+	f.targetFPR = targetFPR
+	f.layers = layers
+	f.mask, f.k, f.nrEntriesMax = layers[0].mask, layers[0].k, layers[0].nrEntriesMax
+	return cr.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,112 @@
+// marshal_test.go - Filter snapshot (de)serialization tests.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright
+// and related and neighboring rights to this software to the public domain
+// worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along
+// with this software. If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package bloom
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	const (
+		entryLength = 32
+		filterSize  = 12
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := New(rand.Reader, filterSize, 0.25)
+	require.NoError(err, "New()")
+
+	entries := make([][entryLength]byte, 0, 64)
+	for i := 0; i < 64; i++ {
+		var ent [entryLength]byte
+		rand.Read(ent[:])
+		f.TestAndSet(ent[:])
+		entries = append(entries, ent)
+	}
+	f.Delta()
+
+	data, err := f.MarshalBinary()
+	require.NoError(err, "MarshalBinary()")
+
+	var restored Filter
+	require.NoError(restored.UnmarshalBinary(data), "UnmarshalBinary()")
+
+	assert.Equal(f.Entries(), restored.Entries(), "Entries()")
+	assert.Equal(f.MaxEntries(), restored.MaxEntries(), "MaxEntries()")
+	assert.Equal(f.K(), restored.K(), "K()")
+	for _, ent := range entries {
+		assert.True(restored.Test(ent[:]), "Test() after restore")
+	}
+}
+
+func TestMarshalCompressedRoundTrip(t *testing.T) {
+	const (
+		entryLength = 32
+		filterSize  = 12
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := New(rand.Reader, filterSize, 0.25)
+	require.NoError(err, "New()")
+
+	var ent [entryLength]byte
+	rand.Read(ent[:])
+	f.TestAndSet(ent[:])
+
+	data, err := f.MarshalBinaryCompressed()
+	require.NoError(err, "MarshalBinaryCompressed()")
+
+	var restored Filter
+	require.NoError(restored.UnmarshalBinary(data), "UnmarshalBinary() of compressed snapshot")
+	assert.True(restored.Test(ent[:]), "Test() after compressed restore")
+}
+
+func TestMarshalCorruptHeaderRejected(t *testing.T) {
+	require := require.New(t)
+
+	f, err := New(rand.Reader, 12, 0.25)
+	require.NoError(err, "New()")
+
+	data, err := f.MarshalBinary()
+	require.NoError(err, "MarshalBinary()")
+
+	// Flip a byte within the header to invalidate its checksum.
+	data[2] ^= 0xff
+
+	var restored Filter
+	err = restored.UnmarshalBinary(data)
+	require.Error(err, "UnmarshalBinary() of corrupted snapshot")
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	require := require.New(t)
+
+	f, err := New(rand.Reader, 12, 0.25)
+	require.NoError(err, "New()")
+
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	require.NoError(err, "WriteTo()")
+	require.Equal(int64(buf.Len()), n, "WriteTo() byte count")
+
+	var restored Filter
+	_, err = restored.ReadFrom(&buf)
+	require.NoError(err, "ReadFrom()")
+	require.Equal(f.MaxEntries(), restored.MaxEntries(), "MaxEntries()")
+}